@@ -0,0 +1,38 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws_ebs
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+// clientTokenFor derives a stable EC2 ClientToken from parts so that
+// retrying the same logical request (e.g. after a controller restart)
+// reuses the in-flight or already-created resource instead of leaking a
+// duplicate snapshot or volume. Hashing keeps the token within EC2's
+// 64-character ClientToken limit regardless of how long parts are. Each
+// part is length-prefixed before hashing so that, e.g., parts ("a/b", "")
+// and ("a", "b/") don't collide on a shared separator.
+func clientTokenFor(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		fmt.Fprintf(h, "%d:%s", len(p), p)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
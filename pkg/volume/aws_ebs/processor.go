@@ -20,7 +20,9 @@ import (
 	"fmt"
 	"strconv"
 	"strings"
+	"sync"
 
+	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/pkg/api/v1"
 	kvol "k8s.io/kubernetes/pkg/volume"
 
@@ -33,7 +35,15 @@ import (
 )
 
 type awsEBSPlugin struct {
-	cloud *aws.Cloud
+	cloud      *aws.Cloud
+	kubeClient kubernetes.Interface
+
+	// ownerAccountIDs caches the AWS account ID backing a given cloud,
+	// keyed by its access key ID, fetched lazily via STS GetCallerIdentity.
+	// Guarded by ownerAccountIDsMu since the plugin instance is shared
+	// across the controller's workers.
+	ownerAccountIDsMu sync.Mutex
+	ownerAccountIDs   map[string]string
 }
 
 var _ volume.VolumePlugin = &awsEBSPlugin{}
@@ -46,11 +56,36 @@ func GetPluginName() string {
 	return "aws_ebs"
 }
 
-func (a *awsEBSPlugin) Init(cloud cloudprovider.Interface) {
+func (a *awsEBSPlugin) Init(cloud cloudprovider.Interface, kubeClient kubernetes.Interface) {
 	a.cloud = cloud.(*aws.Cloud)
+	a.kubeClient = kubeClient
+	a.ownerAccountIDs = make(map[string]string)
 }
 
-func (a *awsEBSPlugin) SnapshotCreate(spec *v1.PersistentVolumeSpec) (*tprv1.VolumeSnapshotDataSource, error) {
+// getOwnerAccountID returns the AWS account ID that owns cloud's
+// credentials, fetching and caching it via STS on first use.
+func (a *awsEBSPlugin) getOwnerAccountID(cloud *aws.Cloud) (string, error) {
+	key := cloud.AccessKeyID()
+
+	a.ownerAccountIDsMu.Lock()
+	accountID, ok := a.ownerAccountIDs[key]
+	a.ownerAccountIDsMu.Unlock()
+	if ok {
+		return accountID, nil
+	}
+
+	accountID, err := cloud.GetCallerIdentity()
+	if err != nil {
+		return "", fmt.Errorf("failed to determine owner account ID: %v", err)
+	}
+
+	a.ownerAccountIDsMu.Lock()
+	a.ownerAccountIDs[key] = accountID
+	a.ownerAccountIDsMu.Unlock()
+	return accountID, nil
+}
+
+func (a *awsEBSPlugin) SnapshotCreate(spec *v1.PersistentVolumeSpec, parameters map[string]string) (*tprv1.VolumeSnapshotDataSource, error) {
 	if spec == nil || spec.AWSElasticBlockStore == nil {
 		return nil, fmt.Errorf("invalid PV spec %v", spec)
 	}
@@ -58,17 +93,138 @@ func (a *awsEBSPlugin) SnapshotCreate(spec *v1.PersistentVolumeSpec) (*tprv1.Vol
 	if ind := strings.LastIndex(volumeId, "/"); ind >= 0 {
 		volumeId = volumeId[(ind + 1):]
 	}
-	snapshotOpt := &aws.SnapshotOptions{
-		VolumeId: volumeId,
+
+	var shareAccounts []string
+	var destinationRegion, kmsKeyId string
+	var encrypted bool
+	var profileSecretName, profileSecretNamespace string
+	var snapshotUID, snapshotGeneration string
+	var err error
+	for k, v := range parameters {
+		switch strings.ToLower(k) {
+		case "createvolumepermissionaccountids":
+			for _, accountID := range strings.Split(v, ",") {
+				if accountID = strings.TrimSpace(accountID); accountID != "" {
+					shareAccounts = append(shareAccounts, accountID)
+				}
+			}
+		case "destinationregion":
+			destinationRegion = v
+		case "kmskeyid":
+			kmsKeyId = v
+		case "encrypted":
+			encrypted, err = strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("invalid encrypted boolean value %q, must be true or false: %v", v, err)
+			}
+		case "profilesecretname":
+			profileSecretName = v
+		case "profilesecretnamespace":
+			profileSecretNamespace = v
+		case "snapshotuid":
+			snapshotUID = v
+		case "snapshotgeneration":
+			snapshotGeneration = v
+		default:
+			return nil, fmt.Errorf("invalid option %q", k)
+		}
 	}
-	snapshotId, err := a.cloud.CreateSnapshot(snapshotOpt)
+
+	profile, err := a.resolveProfile(profileSecretName, profileSecretNamespace)
 	if err != nil {
 		return nil, err
 	}
+	cloud, err := a.cloudForProfile(profile)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(shareAccounts) > 0 {
+		ownerAccountID, err := a.getOwnerAccountID(cloud)
+		if err != nil {
+			return nil, err
+		}
+		for _, accountID := range shareAccounts {
+			if accountID == ownerAccountID {
+				return nil, fmt.Errorf("cannot share snapshot with its own owner account %q", accountID)
+			}
+		}
+	}
+
+	// The controller does not yet inject a per-request VolumeSnapshot
+	// UID/generation into parameters. Without that identity there is no
+	// safe seed for a client token: keying it on the volume instead would
+	// make every snapshot of that volume collide with the first one. So
+	// the idempotent create/reuse path is gated off entirely until
+	// snapshotUID is supplied, falling back to a plain, non-idempotent
+	// CreateSnapshot with no client token.
+	var clientToken string
+	if snapshotUID != "" {
+		clientToken = clientTokenFor(snapshotUID, snapshotGeneration)
+	}
+
+	var snapshotId string
+	var found bool
+	if clientToken != "" {
+		snapshotId, found, err = cloud.DescribeSnapshotByClientToken(cloud.Region(), clientToken)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check for an existing snapshot with client token %s: %v", clientToken, err)
+		}
+	}
+	if found {
+		glog.V(2).Infof("Reusing existing EBS snapshot %s for client token %s", snapshotId, clientToken)
+	} else {
+		snapshotOpt := &aws.SnapshotOptions{
+			VolumeId:    volumeId,
+			ClientToken: clientToken,
+		}
+		snapshotId, err = cloud.CreateSnapshot(snapshotOpt)
+		if err != nil {
+			return nil, err
+		}
+	}
+	sourceRegion := cloud.Region()
+
+	for _, accountID := range shareAccounts {
+		if err := cloud.ModifySnapshotAttribute(snapshotId, aws.SnapshotAttributeCreateVolumePermission, accountID, true); err != nil {
+			return nil, fmt.Errorf("failed to share snapshot %s with account %s: %v", snapshotId, accountID, err)
+		}
+	}
+
+	src := &tprv1.AWSElasticBlockStoreVolumeSnapshotSource{
+		SnapshotID:             snapshotId,
+		Region:                 sourceRegion,
+		ShareAccounts:          shareAccounts,
+		ProfileSecretName:      profileSecretName,
+		ProfileSecretNamespace: profileSecretNamespace,
+	}
+
+	if destinationRegion != "" {
+		var copySnapshotId string
+		var copyFound bool
+		if clientToken != "" {
+			copySnapshotId, copyFound, err = cloud.DescribeSnapshotByClientToken(destinationRegion, clientToken)
+			if err != nil {
+				return nil, fmt.Errorf("failed to check for an existing snapshot copy with client token %s in region %s: %v", clientToken, destinationRegion, err)
+			}
+		}
+		if copyFound {
+			glog.V(2).Infof("Reusing existing EBS snapshot copy %s for client token %s in region %s", copySnapshotId, clientToken, destinationRegion)
+		} else {
+			copySnapshotId, err = cloud.CopySnapshot(sourceRegion, destinationRegion, snapshotId, kmsKeyId, encrypted, clientToken)
+			if err != nil {
+				return nil, fmt.Errorf("failed to copy snapshot %s to region %s: %v", snapshotId, destinationRegion, err)
+			}
+			if err := cloud.WaitForSnapshotCompleted(destinationRegion, copySnapshotId); err != nil {
+				return nil, fmt.Errorf("snapshot copy %s in region %s did not complete: %v", copySnapshotId, destinationRegion, err)
+			}
+		}
+		src.CopySnapshotID = copySnapshotId
+		src.CopyRegion = destinationRegion
+	}
+
 	return &tprv1.VolumeSnapshotDataSource{
-		AWSElasticBlockStore: &tprv1.AWSElasticBlockStoreVolumeSnapshotSource{
-			SnapshotID: snapshotId,
-		},
+		AWSElasticBlockStore: src,
 	}, nil
 }
 
@@ -77,17 +233,48 @@ func (a *awsEBSPlugin) SnapshotDelete(src *tprv1.VolumeSnapshotDataSource, _ *v1
 		return fmt.Errorf("invalid VolumeSnapshotDataSource: %v", src)
 	}
 	snapshotId := src.AWSElasticBlockStore.SnapshotID
-	_, err := a.cloud.DeleteSnapshot(snapshotId)
+
+	profile, err := a.resolveProfile(src.AWSElasticBlockStore.ProfileSecretName, src.AWSElasticBlockStore.ProfileSecretNamespace)
+	if err != nil {
+		return err
+	}
+	cloud, err := a.cloudForProfile(profile)
 	if err != nil {
 		return err
 	}
 
+	for _, accountID := range src.AWSElasticBlockStore.ShareAccounts {
+		if err := cloud.ModifySnapshotAttribute(snapshotId, aws.SnapshotAttributeCreateVolumePermission, accountID, false); err != nil {
+			return fmt.Errorf("failed to revoke snapshot %s permission for account %s: %v", snapshotId, accountID, err)
+		}
+	}
+
+	if copySnapshotId := src.AWSElasticBlockStore.CopySnapshotID; copySnapshotId != "" {
+		if _, err := cloud.DeleteSnapshotInRegion(src.AWSElasticBlockStore.CopyRegion, copySnapshotId); err != nil {
+			return fmt.Errorf("failed to delete snapshot copy %s in region %s: %v", copySnapshotId, src.AWSElasticBlockStore.CopyRegion, err)
+		}
+	}
+
+	if _, err := cloud.DeleteSnapshotInRegion(src.AWSElasticBlockStore.Region, snapshotId); err != nil {
+		return err
+	}
+
 	return nil
 }
 
+// regionFromZone derives the AWS region from an availability zone name,
+// e.g. "us-west-2a" -> "us-west-2".
+func regionFromZone(zone string) string {
+	if zone == "" {
+		return ""
+	}
+	return zone[:len(zone)-1]
+}
+
 func (a *awsEBSPlugin) SnapshotRestore(snapshotData *tprv1.VolumeSnapshotData, pvc *v1.PersistentVolumeClaim, pvName string, parameters map[string]string) (*v1.PersistentVolumeSource, map[string]string, error) {
 	var err error
 	var tags = make(map[string]string)
+	var profileSecretName, profileSecretNamespace string
 	// retrieve VolumeSnapshotDataSource
 	if snapshotData == nil || snapshotData.Spec.AWSElasticBlockStore == nil {
 		return nil, nil, fmt.Errorf("failed to retrieve Snapshot spec")
@@ -97,6 +284,7 @@ func (a *awsEBSPlugin) SnapshotRestore(snapshotData *tprv1.VolumeSnapshotData, p
 	}
 
 	snapId := snapshotData.Spec.AWSElasticBlockStore.SnapshotID
+	snapRegion := snapshotData.Spec.AWSElasticBlockStore.Region
 
 	tags["Name"] = kvol.GenerateVolumeName("External Storage", pvName, 255) // AWS tags can have 255 characters
 
@@ -130,6 +318,10 @@ func (a *awsEBSPlugin) SnapshotRestore(snapshotData *tprv1.VolumeSnapshotData, p
 			}
 		case "kmskeyid":
 			volumeOptions.KmsKeyId = v
+		case "profilesecretname":
+			profileSecretName = v
+		case "profilesecretnamespace":
+			profileSecretNamespace = v
 		default:
 			return nil, nil, fmt.Errorf("invalid option %q", k)
 		}
@@ -140,14 +332,50 @@ func (a *awsEBSPlugin) SnapshotRestore(snapshotData *tprv1.VolumeSnapshotData, p
 		return nil, nil, fmt.Errorf("claim.Spec.Selector is not supported for dynamic provisioning on AWS")
 	}
 
-	volumeID, err := a.cloud.CreateDisk(volumeOptions)
+	// If the snapshot was copied cross-region and the target zone falls in
+	// the copy's region, restore from the copy instead of the original.
+	if copyRegion := snapshotData.Spec.AWSElasticBlockStore.CopyRegion; copyRegion != "" {
+		if targetRegion := regionFromZone(volumeOptions.AvailabilityZone); targetRegion == copyRegion {
+			volumeOptions.SnapshotId = snapshotData.Spec.AWSElasticBlockStore.CopySnapshotID
+			snapRegion = copyRegion
+		}
+	}
+	volumeOptions.Region = snapRegion
+
+	// Default to the profile the snapshot was created under, unless the
+	// StorageClass parameters override it (e.g. restoring into a different
+	// account than the one the backup was taken from).
+	if profileSecretName == "" {
+		profileSecretName = snapshotData.Spec.AWSElasticBlockStore.ProfileSecretName
+		profileSecretNamespace = snapshotData.Spec.AWSElasticBlockStore.ProfileSecretNamespace
+	}
+	profile, err := a.resolveProfile(profileSecretName, profileSecretNamespace)
+	if err != nil {
+		return nil, nil, err
+	}
+	cloud, err := a.cloudForProfile(profile)
 	if err != nil {
-		glog.V(2).Infof("Error creating EBS Disk volume: %v", err)
 		return nil, nil, err
 	}
-	glog.V(2).Infof("Successfully created EBS Disk volume %s", volumeID)
 
-	labels, err := a.cloud.GetVolumeLabels(volumeID)
+	clientToken := clientTokenFor(string(pvc.UID), pvName)
+	volumeID, found, err := cloud.DescribeVolumeByClientToken(volumeOptions.Region, clientToken)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to check for an existing volume with client token %s: %v", clientToken, err)
+	}
+	if found {
+		glog.V(2).Infof("Reusing existing EBS volume %s for client token %s", volumeID, clientToken)
+	} else {
+		volumeOptions.ClientToken = clientToken
+		volumeID, err = cloud.CreateDisk(volumeOptions)
+		if err != nil {
+			glog.V(2).Infof("Error creating EBS Disk volume: %v", err)
+			return nil, nil, err
+		}
+		glog.V(2).Infof("Successfully created EBS Disk volume %s", volumeID)
+	}
+
+	labels, err := cloud.GetVolumeLabels(volumeID)
 	if err != nil {
 		// We don't really want to leak the volume here...
 		glog.Errorf("error building labels for new EBS volume %q: %v", volumeID, err)
@@ -0,0 +1,96 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package aws_ebs
+
+import (
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/rootfs/snapshot/pkg/cloudprovider/providers/aws"
+)
+
+const (
+	// defaultProfileSecretNamespace is used when a profile secret name is
+	// given without an accompanying namespace.
+	defaultProfileSecretNamespace = "default"
+
+	profileSecretAccessKeyIDKey     = "accessKeyID"
+	profileSecretSecretAccessKeyKey = "secretAccessKey"
+	profileSecretSessionTokenKey    = "sessionToken"
+	profileSecretRegionKey          = "region"
+)
+
+// Profile holds AWS credentials and a region scoped to a single
+// snapshot/restore request. It lets a single controller operate across
+// multiple AWS accounts or IAM roles instead of being pinned to the single
+// *aws.Cloud bound at Init time.
+type Profile struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	SessionToken    string
+	Region          string
+}
+
+// resolveProfile fetches the Secret named secretName in secretNamespace and
+// decodes it into a Profile. An empty secretName means no profile was
+// requested, in which case resolveProfile returns (nil, nil) so callers
+// fall back to the plugin's Init-provided cloud.
+func (a *awsEBSPlugin) resolveProfile(secretName, secretNamespace string) (*Profile, error) {
+	if secretName == "" {
+		return nil, nil
+	}
+	if a.kubeClient == nil {
+		return nil, fmt.Errorf("no kube client configured, cannot resolve profile secret %q", secretName)
+	}
+	if secretNamespace == "" {
+		secretNamespace = defaultProfileSecretNamespace
+	}
+	secret, err := a.kubeClient.Core().Secrets(secretNamespace).Get(secretName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get profile secret %s/%s: %v", secretNamespace, secretName, err)
+	}
+	return &Profile{
+		AccessKeyID:     string(secret.Data[profileSecretAccessKeyIDKey]),
+		SecretAccessKey: string(secret.Data[profileSecretSecretAccessKeyKey]),
+		SessionToken:    string(secret.Data[profileSecretSessionTokenKey]),
+		Region:          string(secret.Data[profileSecretRegionKey]),
+	}, nil
+}
+
+// cloudForProfile returns a.cloud when profile is nil, or a scoped
+// *aws.Cloud built from profile otherwise. The scoped cloud's credentials
+// are validated with GetCallerIdentity before being handed back, so a bad
+// profile fails fast instead of surfacing as an opaque EC2 error later.
+func (a *awsEBSPlugin) cloudForProfile(profile *Profile) (*aws.Cloud, error) {
+	if profile == nil {
+		return a.cloud, nil
+	}
+	scopedCloud, err := aws.NewCloud(&aws.CloudConfig{
+		AccessKeyID:     profile.AccessKeyID,
+		SecretAccessKey: profile.SecretAccessKey,
+		SessionToken:    profile.SessionToken,
+		Region:          profile.Region,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build cloud from profile: %v", err)
+	}
+	if _, err := scopedCloud.GetCallerIdentity(); err != nil {
+		return nil, fmt.Errorf("profile credentials failed validation: %v", err)
+	}
+	return scopedCloud, nil
+}
@@ -0,0 +1,157 @@
+/*
+Copyright 2017 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gce_pd
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/pkg/api/v1"
+	kvol "k8s.io/kubernetes/pkg/volume"
+
+	"github.com/golang/glog"
+
+	tprv1 "github.com/rootfs/snapshot/pkg/apis/tpr/v1"
+	"github.com/rootfs/snapshot/pkg/cloudprovider"
+	"github.com/rootfs/snapshot/pkg/cloudprovider/providers/gce"
+	"github.com/rootfs/snapshot/pkg/volume"
+)
+
+// gcePDNameMaxLength is the maximum length of a GCE PD resource name, far
+// shorter than the 255 characters EBS tolerates.
+const gcePDNameMaxLength = 63
+
+type gcePersistentDiskPlugin struct {
+	cloud *gce.Cloud
+}
+
+var _ volume.VolumePlugin = &gcePersistentDiskPlugin{}
+
+func RegisterPlugin() volume.VolumePlugin {
+	return &gcePersistentDiskPlugin{}
+}
+
+func GetPluginName() string {
+	return "gce_pd"
+}
+
+func (g *gcePersistentDiskPlugin) Init(cloud cloudprovider.Interface, _ kubernetes.Interface) {
+	g.cloud = cloud.(*gce.Cloud)
+}
+
+func (g *gcePersistentDiskPlugin) SnapshotCreate(spec *v1.PersistentVolumeSpec, parameters map[string]string) (*tprv1.VolumeSnapshotDataSource, error) {
+	if spec == nil || spec.GCEPersistentDisk == nil {
+		return nil, fmt.Errorf("invalid PV spec %v", spec)
+	}
+	// No SnapshotCreate-time parameters are defined for gce_pd yet; reject
+	// anything unrecognized so a mis-set snapshot class fails loudly
+	// instead of being silently ignored.
+	for k := range parameters {
+		return nil, fmt.Errorf("invalid option %q", k)
+	}
+
+	diskName := spec.GCEPersistentDisk.PDName
+	snapshotOpt := &gce.SnapshotOptions{
+		DiskName: diskName,
+	}
+	snapshotId, err := g.cloud.CreateSnapshot(snapshotOpt)
+	if err != nil {
+		return nil, err
+	}
+	return &tprv1.VolumeSnapshotDataSource{
+		GCEPersistentDisk: &tprv1.GCEPersistentDiskVolumeSnapshotSource{
+			SnapshotName: snapshotId,
+		},
+	}, nil
+}
+
+func (g *gcePersistentDiskPlugin) SnapshotDelete(src *tprv1.VolumeSnapshotDataSource, _ *v1.PersistentVolume) error {
+	if src == nil || src.GCEPersistentDisk == nil {
+		return fmt.Errorf("invalid VolumeSnapshotDataSource: %v", src)
+	}
+	snapshotName := src.GCEPersistentDisk.SnapshotName
+	if err := g.cloud.DeleteSnapshot(snapshotName); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (g *gcePersistentDiskPlugin) SnapshotRestore(snapshotData *tprv1.VolumeSnapshotData, pvc *v1.PersistentVolumeClaim, pvName string, parameters map[string]string) (*v1.PersistentVolumeSource, map[string]string, error) {
+	var err error
+	var tags = make(map[string]string)
+	// retrieve VolumeSnapshotDataSource
+	if snapshotData == nil || snapshotData.Spec.GCEPersistentDisk == nil {
+		return nil, nil, fmt.Errorf("failed to retrieve Snapshot spec")
+	}
+	if pvc == nil {
+		return nil, nil, fmt.Errorf("nil pvc")
+	}
+
+	snapshotName := snapshotData.Spec.GCEPersistentDisk.SnapshotName
+
+	tags["Name"] = kvol.GenerateVolumeName("External Storage", pvName, gcePDNameMaxLength)
+
+	capacity := pvc.Spec.Resources.Requests[v1.ResourceName(v1.ResourceStorage)]
+	requestBytes := capacity.Value()
+	// GCE works with gigabytes, convert to GiB with rounding up
+	requestGB := int64(kvol.RoundUpSize(requestBytes, 1024*1024*1024))
+	diskOptions := &gce.VolumeOptions{
+		CapacityGB:   requestGB,
+		Tags:         tags,
+		PVCName:      pvc.Name,
+		SnapshotName: snapshotName,
+	}
+	// Apply Parameters (case-insensitive). We leave validation of
+	// the values to the cloud provider.
+	for k, v := range parameters {
+		switch strings.ToLower(k) {
+		case "type":
+			diskOptions.DiskType = v
+		case "zone":
+			diskOptions.Zone = v
+		case "replication-type":
+			diskOptions.ReplicationType = v
+		default:
+			return nil, nil, fmt.Errorf("invalid option %q", k)
+		}
+	}
+
+	// TODO: implement PVC.Selector parsing
+	if pvc.Spec.Selector != nil {
+		return nil, nil, fmt.Errorf("claim.Spec.Selector is not supported for dynamic provisioning on GCE")
+	}
+
+	diskName, err := g.cloud.CreateDisk(diskOptions)
+	if err != nil {
+		glog.V(2).Infof("Error creating GCE PD volume: %v", err)
+		return nil, nil, err
+	}
+	glog.V(2).Infof("Successfully created GCE PD volume %s", diskName)
+
+	pv := &v1.PersistentVolumeSource{
+		GCEPersistentDisk: &v1.GCEPersistentDiskVolumeSource{
+			PDName:    diskName,
+			FSType:    "ext4",
+			Partition: 0,
+			ReadOnly:  false,
+		},
+	}
+
+	return pv, tags, nil
+}